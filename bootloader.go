@@ -0,0 +1,377 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// defaultGrubEnvFile is where the GRUB implementation keeps its
+// grub-editenv-style key=value state, on the boot partition.
+const defaultGrubEnvFile = "/boot/grub/mender_grubenv"
+
+// defaultBootLimit is how many times BootAttempt lets an uncommitted
+// upgrade boot before rolling it back, if the caller doesn't configure one.
+const defaultBootLimit = 3
+
+var (
+	// ErrNoPreviousBootPartition is returned by Rollback when no previous
+	// partition has been recorded to revert to, i.e. BeginUpgrade has
+	// never been called. A committed upgrade keeps its record, so
+	// Rollback after CommitUpgrade still succeeds.
+	ErrNoPreviousBootPartition = errors.New("no previous boot partition recorded to roll back to")
+	// ErrBootLimitExceeded is returned by BootAttempt when it has just
+	// rolled back an upgrade that failed to commit within BootLimit
+	// boots.
+	ErrBootLimitExceeded = errors.New("boot attempt limit exceeded, rolled back to previous partition")
+	// ErrBootPartNotSet is returned by GetBootPartition when the
+	// bootloader has no boot_part variable at all, e.g. on first boot
+	// before Mender ever set one. This is distinct from a boot_part that
+	// was read but didn't match the expected root partition.
+	ErrBootPartNotSet = errors.New("boot_part is not set in the bootloader environment")
+)
+
+// uBootBootCountScript is a reference U-Boot boot script implementing the
+// same bootcount/rollback logic BootAttempt models in Go, for devices that
+// drive the counter from "bootcmd" instead of (or in addition to) calling
+// BootAttempt early in the userspace boot sequence.
+const uBootBootCountScript = `
+if test "${upgrade_available}" = "1"; then
+    if test "${bootcount}" -ge "${bootlimit}"; then
+        echo "Rolling back to boot_part=${boot_part_prev}: boot limit exceeded"
+        setenv boot_part "${boot_part_prev}"
+        setenv upgrade_available 0
+        setenv bootcount 0
+    else
+        setexpr bootcount ${bootcount} + 1
+    fi
+    saveenv
+fi
+`
+
+// Bootloader abstracts the device's bootloader, so the rest of Mender does
+// not need to know whether it is running on U-Boot, GRUB, or something
+// else entirely.
+type Bootloader interface {
+	// GetBootPartition returns the partition the bootloader will boot
+	// from on the next reset.
+	GetBootPartition() (string, error)
+	// SetBootPartition tells the bootloader which partition to boot
+	// from on the next reset.
+	SetBootPartition(part string) error
+	// MarkUpgradeCommitted tells the bootloader that the currently
+	// booted upgrade is good and should not be rolled back.
+	MarkUpgradeCommitted() error
+	// Name identifies the bootloader implementation, e.g. for logging.
+	Name() string
+
+	// BeginUpgrade records newSlot as the partition to boot next,
+	// remembers the previously active slot for Rollback, and arms the
+	// boot-count watchdog by resetting bootcount to 0.
+	BeginUpgrade(newSlot string) error
+	// CommitUpgrade tells the bootloader the upgrade just booted is
+	// good: the watchdog is disarmed and bootcount is reset.
+	CommitUpgrade() error
+	// Rollback reverts boot_part to the slot that was active before the
+	// last BeginUpgrade, and disarms the watchdog.
+	Rollback() error
+	// BootAttempt records one more boot of an uncommitted upgrade,
+	// returning the resulting attempt count and the configured limit. If
+	// the count exceeds the limit, it rolls back the upgrade itself and
+	// returns ErrBootLimitExceeded.
+	BootAttempt() (n int, limit int, err error)
+}
+
+// NewBootloader constructs the Bootloader named by bootloaderType ("uboot"
+// or "grub"). An empty bootloaderType auto-detects the bootloader in use
+// based on which binaries/files are present on the device. bootLimit is the
+// number of unconfirmed boots BootAttempt allows before rolling back; 0
+// uses defaultBootLimit.
+func NewBootloader(bootloaderType string, bootLimit int) (Bootloader, error) {
+	if bootloaderType == "" {
+		bootloaderType = detectBootloaderType()
+	}
+
+	switch bootloaderType {
+	case "uboot":
+		return &uBootBootloader{env: uBootEnv{osCalls{}}, bootLimit: bootLimit}, nil
+	case "grub":
+		return &grubBootloader{envFile: defaultGrubEnvFile, bootLimit: bootLimit}, nil
+	default:
+		return nil, fmt.Errorf("unsupported bootloader type %q", bootloaderType)
+	}
+}
+
+// detectBootloaderType picks U-Boot if its fw_printenv tool is on PATH,
+// falling back to GRUB if its env file is already present, and defaulting
+// to U-Boot to preserve historical behavior.
+func detectBootloaderType() string {
+	if _, err := exec.LookPath("fw_printenv"); err == nil {
+		return "uboot"
+	}
+	if _, err := os.Stat(defaultGrubEnvFile); err == nil {
+		return "grub"
+	}
+	return "uboot"
+}
+
+// uBootBootloader implements Bootloader on top of U-Boot's
+// fw_printenv/fw_setenv tools.
+type uBootBootloader struct {
+	env       BootEnvReadWriter
+	bootLimit int
+}
+
+func (u *uBootBootloader) Name() string {
+	return "uboot"
+}
+
+func (u *uBootBootloader) GetBootPartition() (string, error) {
+	vars, err := u.env.ReadEnv("boot_part")
+	if err != nil {
+		return "", err
+	}
+	part, ok := vars["boot_part"]
+	if !ok {
+		return "", ErrBootPartNotSet
+	}
+	return part, nil
+}
+
+func (u *uBootBootloader) SetBootPartition(part string) error {
+	return u.env.WriteEnv(map[string]string{"boot_part": part})
+}
+
+func (u *uBootBootloader) MarkUpgradeCommitted() error {
+	return u.CommitUpgrade()
+}
+
+func (u *uBootBootloader) limit() int {
+	if u.bootLimit > 0 {
+		return u.bootLimit
+	}
+	return defaultBootLimit
+}
+
+func (u *uBootBootloader) BeginUpgrade(newSlot string) error {
+	// upgrade_available/bootcount must reach the bootenv before boot_part
+	// does: WriteEnv issues one fw_setenv call per variable, so if power
+	// is lost mid-call, writing the watchdog-arming vars first guarantees
+	// a crash can only ever leave the device on the old, good slot
+	// instead of booting the new slot with the watchdog unarmed.
+	if err := u.env.WriteEnv(map[string]string{
+		"upgrade_available": "1",
+		"bootcount":         "0",
+	}); err != nil {
+		return err
+	}
+
+	vars := map[string]string{"boot_part": newSlot}
+	if current, err := u.env.ReadEnv("boot_part"); err == nil {
+		if prev, ok := current["boot_part"]; ok {
+			vars["boot_part_prev"] = prev
+		}
+	}
+	return u.env.WriteEnv(vars)
+}
+
+func (u *uBootBootloader) CommitUpgrade() error {
+	return u.env.WriteEnv(map[string]string{
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	})
+}
+
+func (u *uBootBootloader) Rollback() error {
+	vars, err := u.env.ReadEnv("boot_part_prev")
+	if err != nil {
+		return err
+	}
+	prev, ok := vars["boot_part_prev"]
+	if !ok {
+		return ErrNoPreviousBootPartition
+	}
+	return u.env.WriteEnv(map[string]string{
+		"boot_part":         prev,
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	})
+}
+
+func (u *uBootBootloader) BootAttempt() (int, int, error) {
+	limit := u.limit()
+
+	vars, err := u.env.ReadEnv("upgrade_available", "bootcount")
+	if err != nil {
+		return 0, limit, err
+	}
+	if vars["upgrade_available"] != "1" {
+		// No upgrade in progress: nothing to watch, so leave bootcount
+		// untouched rather than arming a rollback on an ordinary boot.
+		return 0, limit, nil
+	}
+	count, _ := strconv.Atoi(vars["bootcount"])
+	count++
+
+	if err := u.env.WriteEnv(map[string]string{"bootcount": strconv.Itoa(count)}); err != nil {
+		return count, limit, err
+	}
+
+	if count > limit {
+		if err := u.Rollback(); err != nil {
+			return count, limit, err
+		}
+		return count, limit, ErrBootLimitExceeded
+	}
+	return count, limit, nil
+}
+
+// grubBootloader implements Bootloader on top of a grub-editenv-style
+// key=value file living on the boot partition.
+type grubBootloader struct {
+	envFile   string
+	bootLimit int
+}
+
+func (g *grubBootloader) Name() string {
+	return "grub"
+}
+
+func (g *grubBootloader) GetBootPartition() (string, error) {
+	vars, err := readGrubEnvFile(g.envFile)
+	if err != nil {
+		return "", err
+	}
+	part, ok := vars["mender_boot_part"]
+	if !ok {
+		return "", ErrBootPartNotSet
+	}
+	return part, nil
+}
+
+func (g *grubBootloader) SetBootPartition(part string) error {
+	return writeGrubEnvFile(g.envFile, map[string]string{"mender_boot_part": part})
+}
+
+func (g *grubBootloader) MarkUpgradeCommitted() error {
+	return g.CommitUpgrade()
+}
+
+func (g *grubBootloader) limit() int {
+	if g.bootLimit > 0 {
+		return g.bootLimit
+	}
+	return defaultBootLimit
+}
+
+func (g *grubBootloader) BeginUpgrade(newSlot string) error {
+	vars := map[string]string{
+		"mender_boot_part":  newSlot,
+		"upgrade_available": "1",
+		"mender_bootcount":  "0",
+	}
+	if current, err := readGrubEnvFile(g.envFile); err == nil {
+		if prev, ok := current["mender_boot_part"]; ok {
+			vars["mender_boot_part_prev"] = prev
+		}
+	}
+	return writeGrubEnvFile(g.envFile, vars)
+}
+
+func (g *grubBootloader) CommitUpgrade() error {
+	return writeGrubEnvFile(g.envFile, map[string]string{
+		"upgrade_available": "0",
+		"mender_bootcount":  "0",
+	})
+}
+
+func (g *grubBootloader) Rollback() error {
+	vars, err := readGrubEnvFile(g.envFile)
+	if err != nil {
+		return err
+	}
+	prev, ok := vars["mender_boot_part_prev"]
+	if !ok {
+		return ErrNoPreviousBootPartition
+	}
+	return writeGrubEnvFile(g.envFile, map[string]string{
+		"mender_boot_part":  prev,
+		"upgrade_available": "0",
+		"mender_bootcount":  "0",
+	})
+}
+
+func (g *grubBootloader) BootAttempt() (int, int, error) {
+	limit := g.limit()
+
+	vars, err := readGrubEnvFile(g.envFile)
+	if err != nil {
+		return 0, limit, err
+	}
+	if vars["upgrade_available"] != "1" {
+		// No upgrade in progress: nothing to watch, so leave bootcount
+		// untouched rather than arming a rollback on an ordinary boot.
+		return 0, limit, nil
+	}
+	count, _ := strconv.Atoi(vars["mender_bootcount"])
+	count++
+
+	if err := writeGrubEnvFile(g.envFile, map[string]string{"mender_bootcount": strconv.Itoa(count)}); err != nil {
+		return count, limit, err
+	}
+
+	if count > limit {
+		if err := g.Rollback(); err != nil {
+			return count, limit, err
+		}
+		return count, limit, ErrBootLimitExceeded
+	}
+	return count, limit, nil
+}
+
+// readGrubEnvFile parses a grub-editenv-style key=value file.
+func readGrubEnvFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseBootEnvOutput(data), nil
+}
+
+// writeGrubEnvFile merges vars into the existing key=value file at path,
+// writing the whole file back out, much like `grub-editenv set` does.
+func writeGrubEnvFile(path string, vars map[string]string) error {
+	existing, err := readGrubEnvFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if existing == nil {
+		existing = make(map[string]string)
+	}
+	for name, value := range vars {
+		existing[name] = value
+	}
+
+	var buf bytes.Buffer
+	for name, value := range existing {
+		fmt.Fprintf(&buf, "%s=%s\n", name, value)
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
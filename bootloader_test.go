@@ -0,0 +1,298 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_uBootBootloader_SetBootPartition(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{"boot_part": "2"}}
+	b := &uBootBootloader{env: env}
+
+	assert.NoError(t, b.SetBootPartition("3"))
+	assert.Equal(t, "3", env.vars["boot_part"])
+}
+
+func Test_uBootBootloader_GetBootPartition_NotSet(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{}}
+	b := &uBootBootloader{env: env}
+
+	_, err := b.GetBootPartition()
+	assert.Equal(t, ErrBootPartNotSet, err)
+}
+
+func Test_grubBootloader_GetBootPartition_NotSet(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "mender_grubenv")
+	assert.NoError(t, writeGrubEnvFile(envFile, map[string]string{"some_other_var": "1"}))
+	g := &grubBootloader{envFile: envFile}
+
+	_, err := g.GetBootPartition()
+	assert.Equal(t, ErrBootPartNotSet, err)
+}
+
+func Test_NewBootloader(t *testing.T) {
+	b, err := NewBootloader("uboot", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "uboot", b.Name())
+	assert.Equal(t, 5, b.(*uBootBootloader).bootLimit)
+
+	b, err = NewBootloader("grub", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "grub", b.Name())
+	assert.Equal(t, defaultGrubEnvFile, b.(*grubBootloader).envFile)
+
+	_, err = NewBootloader("does-not-exist", 0)
+	assert.Error(t, err)
+}
+
+// withPATH temporarily replaces $PATH for the duration of the test.
+func withPATH(t *testing.T, path string) {
+	old := os.Getenv("PATH")
+	assert.NoError(t, os.Setenv("PATH", path))
+	t.Cleanup(func() { os.Setenv("PATH", old) })
+}
+
+func Test_detectBootloaderType_FwPrintenvOnPath(t *testing.T) {
+	dir := t.TempDir()
+	fwPrintenv := filepath.Join(dir, "fw_printenv")
+	assert.NoError(t, ioutil.WriteFile(fwPrintenv, []byte("#!"+"/bin/sh\n"), 0755))
+	withPATH(t, dir)
+
+	assert.Equal(t, "uboot", detectBootloaderType())
+}
+
+func Test_detectBootloaderType_DefaultsToUBoot(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("defaultGrubEnvFile is a Linux path")
+	}
+	if _, err := os.Stat(defaultGrubEnvFile); err == nil {
+		t.Skip("defaultGrubEnvFile already exists on this machine")
+	}
+	withPATH(t, t.TempDir())
+
+	assert.Equal(t, "uboot", detectBootloaderType())
+}
+
+// Test_uBootBootloader_BeginUpgrade_ArmsWatchdogBeforeBootPart guards
+// against a crash mid-BeginUpgrade leaving the device booting the new,
+// possibly-broken slot with the watchdog unarmed: upgrade_available and
+// bootcount must reach the bootenv before boot_part does.
+func Test_uBootBootloader_BeginUpgrade_ArmsWatchdogBeforeBootPart(t *testing.T) {
+	runner := newRecordingRunner()
+	b := &uBootBootloader{env: uBootEnv{BootEnvRunner: runner}}
+
+	assert.NoError(t, b.BeginUpgrade("3"))
+
+	var bootPartCallIndex, armingCallsBeforeBootPart = -1, 0
+	for i, call := range *runner.calls {
+		if call[0] != "fw_setenv" {
+			continue
+		}
+		if call[1] == "boot_part" {
+			bootPartCallIndex = i
+			continue
+		}
+		if bootPartCallIndex == -1 && (call[1] == "upgrade_available" || call[1] == "bootcount") {
+			armingCallsBeforeBootPart++
+		}
+	}
+
+	assert.NotEqual(t, -1, bootPartCallIndex, "boot_part was never written")
+	assert.Equal(t, 2, armingCallsBeforeBootPart,
+		"upgrade_available and bootcount must both be written before boot_part")
+}
+
+func Test_BeginCommitRollbackUpgrade(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{"boot_part": "2"}}
+	b := &uBootBootloader{env: env}
+
+	assert.NoError(t, b.BeginUpgrade("3"))
+	assert.Equal(t, "3", env.vars["boot_part"])
+	assert.Equal(t, "2", env.vars["boot_part_prev"])
+	assert.Equal(t, "1", env.vars["upgrade_available"])
+	assert.Equal(t, "0", env.vars["bootcount"])
+
+	assert.NoError(t, b.CommitUpgrade())
+	assert.Equal(t, "0", env.vars["upgrade_available"])
+
+	// The upgrade is committed, but boot_part_prev is still around from
+	// the last BeginUpgrade, so Rollback succeeds.
+	assert.NoError(t, b.Rollback())
+	assert.Equal(t, "2", env.vars["boot_part"])
+	assert.Equal(t, "0", env.vars["upgrade_available"])
+}
+
+func Test_Rollback_NoUpgradeInProgress(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{"boot_part": "2"}}
+	b := &uBootBootloader{env: env}
+
+	assert.Equal(t, ErrNoPreviousBootPartition, b.Rollback())
+}
+
+func Test_BootAttempt_RollsBackAtLimit(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{"boot_part": "2"}}
+	b := &uBootBootloader{env: env, bootLimit: 3}
+
+	assert.NoError(t, b.BeginUpgrade("3"))
+
+	for i := 1; i <= 3; i++ {
+		n, limit, err := b.BootAttempt()
+		assert.NoError(t, err)
+		assert.Equal(t, i, n)
+		assert.Equal(t, 3, limit)
+	}
+
+	// The 4th boot without a commit exceeds the limit: BootAttempt rolls
+	// back to boot_part=2 itself and reports ErrBootLimitExceeded.
+	n, limit, err := b.BootAttempt()
+	assert.Equal(t, ErrBootLimitExceeded, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, 3, limit)
+	assert.Equal(t, "2", env.vars["boot_part"])
+	assert.Equal(t, "0", env.vars["upgrade_available"])
+}
+
+func Test_BootAttempt_DefaultLimit(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{"upgrade_available": "1", "bootcount": "2"}}
+	b := &uBootBootloader{env: env}
+
+	n, limit, err := b.BootAttempt()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, defaultBootLimit, limit)
+}
+
+func Test_BootAttempt_NoUpgradeInProgress_IsNoop(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{"bootcount": "2"}}
+	b := &uBootBootloader{env: env}
+
+	n, limit, err := b.BootAttempt()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, defaultBootLimit, limit)
+	// bootcount must be left exactly as it was: no watchdog armed.
+	assert.Equal(t, "2", env.vars["bootcount"])
+}
+
+func Test_CommitUpgrade_StopsRollback(t *testing.T) {
+	env := fakeBootEnv{vars: map[string]string{"boot_part": "2"}}
+	b := &uBootBootloader{env: env, bootLimit: 3}
+
+	assert.NoError(t, b.BeginUpgrade("3"))
+	for i := 0; i < 2; i++ {
+		_, _, err := b.BootAttempt()
+		assert.NoError(t, err)
+	}
+
+	// Userspace declares success before hitting the limit: upgrade_available
+	// is cleared, and further boots are ordinary boots BootAttempt ignores.
+	assert.NoError(t, b.CommitUpgrade())
+
+	n, _, err := b.BootAttempt()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "3", env.vars["boot_part"])
+}
+
+// newGrubBootloaderForTest builds a grubBootloader backed by a scratch
+// env file, seeded with boot_part.
+func newGrubBootloaderForTest(t *testing.T, bootPart string) *grubBootloader {
+	dir := t.TempDir()
+	envFile := dir + "/mender_grubenv"
+	assert.NoError(t, writeGrubEnvFile(envFile, map[string]string{"mender_boot_part": bootPart}))
+	return &grubBootloader{envFile: envFile}
+}
+
+func Test_grubBootloader_BeginCommitRollbackUpgrade(t *testing.T) {
+	g := newGrubBootloaderForTest(t, "2")
+
+	assert.NoError(t, g.BeginUpgrade("3"))
+	part, err := g.GetBootPartition()
+	assert.NoError(t, err)
+	assert.Equal(t, "3", part)
+
+	assert.NoError(t, g.CommitUpgrade())
+
+	assert.NoError(t, g.Rollback())
+	part, err = g.GetBootPartition()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", part)
+}
+
+func Test_grubBootloader_BootAttempt_RollsBackAtLimit(t *testing.T) {
+	g := newGrubBootloaderForTest(t, "2")
+	g.bootLimit = 2
+	assert.NoError(t, g.BeginUpgrade("3"))
+
+	for i := 1; i <= 2; i++ {
+		n, limit, err := g.BootAttempt()
+		assert.NoError(t, err)
+		assert.Equal(t, i, n)
+		assert.Equal(t, 2, limit)
+	}
+
+	_, _, err := g.BootAttempt()
+	assert.Equal(t, ErrBootLimitExceeded, err)
+
+	part, err := g.GetBootPartition()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", part)
+}
+
+// Test_FailoverScenarios simulates the snappy-style failover cases this
+// request names: a crash partway through boot, a boot hang caught by a
+// userspace watchdog timeout, and a zero-size/corrupt kernel image. In all
+// three, no commit ever happens, so repeated reboots must exhaust
+// BootLimit and flip the device back to the known-good slot.
+func Test_FailoverScenarios(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		reboots int
+	}{
+		{"crash partway through boot", 1},
+		{"boot hang caught by watchdog timeout", 2},
+		{"zero-size kernel image", 1},
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			env := fakeBootEnv{vars: map[string]string{"boot_part": "2"}}
+			b := &uBootBootloader{env: env, bootLimit: 3}
+			assert.NoError(t, b.BeginUpgrade("3"))
+
+			var err error
+			// Each scenario allows 3+reboots boots of the bad upgrade,
+			// and none of them ever commits, so every scenario stops at
+			// the 4th boot, when BootAttempt rolls back.
+			for attempt := 0; attempt < 3+s.reboots; attempt++ {
+				_, _, err = b.BootAttempt()
+				if err != nil {
+					break
+				}
+			}
+
+			assert.Equal(t, ErrBootLimitExceeded, err)
+			assert.Equal(t, "2", env.vars["boot_part"])
+			assert.Equal(t, "0", env.vars["upgrade_available"])
+		})
+	}
+}
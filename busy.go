@@ -0,0 +1,146 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysClassBlockDir and procSelfMountinfo are the real locations
+// checkInactiveNotInUse reads from; tests point checkPartitionNotInUse at
+// a fake tree by passing other locations as arguments instead.
+const (
+	sysClassBlockDir  = "/sys/class/block"
+	procSelfMountinfo = "/proc/self/mountinfo"
+)
+
+// ErrInactivePartitionBusy is returned when the partition about to be
+// written to as the inactive/target slot turns out to still be in use,
+// e.g. because it backs a device-mapper target or is mounted somewhere.
+var ErrInactivePartitionBusy = errors.New("inactive partition is currently in use")
+
+// checkInactiveNotInUse guards against writing to device as the inactive
+// partition while something still holds it open, which would otherwise
+// corrupt a live rootfs.
+func (p *partitions) checkInactiveNotInUse(device string) error {
+	return checkPartitionNotInUse(device, sysClassBlockDir, procSelfMountinfo)
+}
+
+// checkPartitionNotInUse is checkInactiveNotInUse's testable core: it takes
+// the /sys/class/block and /proc/.../mountinfo locations as arguments so
+// tests can point it at a fake tree.
+func checkPartitionNotInUse(device, sysClassBlockDir, mountinfoPath string) error {
+	hasHolders, err := partitionHasHolders(device, sysClassBlockDir)
+	if err != nil {
+		return err
+	}
+	if hasHolders {
+		return ErrInactivePartitionBusy
+	}
+
+	mounted, err := partitionIsMounted(device, mountinfoPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return ErrInactivePartitionBusy
+	}
+
+	return nil
+}
+
+// partitionHasHolders reports whether device has any entries under
+// /sys/class/block/<node>/holders/, which device-mapper, LVM and md leave
+// behind for any block device they have claimed.
+func partitionHasHolders(device, sysClassBlockDir string) (bool, error) {
+	node := filepath.Base(device)
+	holders, err := ioutil.ReadDir(filepath.Join(sysClassBlockDir, node, "holders"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(holders) > 0, nil
+}
+
+// partitionIsMounted reports whether device, or one of its child
+// partitions, appears as a mount source anywhere in /proc/self/mountinfo.
+func partitionIsMounted(device, mountinfoPath string) (bool, error) {
+	data, err := ioutil.ReadFile(mountinfoPath)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+2 >= len(fields) {
+			continue
+		}
+
+		source := fields[sep+2]
+		if source == device {
+			return true, nil
+		}
+		if strings.HasPrefix(source, device) && isChildPartitionSuffix(device, source[len(device):]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isChildPartitionSuffix reports whether suffix - the remainder of a mount
+// source after stripping the candidate device prefix - looks like a
+// kernel-assigned child partition suffix of device, e.g. "1" (sda -> sda1)
+// or "p1" (mmcblk0 -> mmcblk0p1), rather than an unrelated device that
+// merely shares device as a string prefix (e.g. /dev/mmc2 vs /dev/mmc22).
+func isChildPartitionSuffix(device, suffix string) bool {
+	if device == "" || suffix == "" {
+		return false
+	}
+
+	if lastByte := device[len(device)-1]; lastByte >= '0' && lastByte <= '9' {
+		// device's own name already ends in a digit (mmcblk0, nvme0n1,
+		// loop0, ...), so the kernel disambiguates its partitions with
+		// a "p" separator; without it, a bare digit suffix is exactly
+		// the ambiguity GetInactive's number-based pairing already
+		// rejects (e.g. "/dev/mmc2" vs "/dev/mmc22").
+		if !strings.HasPrefix(suffix, "p") {
+			return false
+		}
+		suffix = suffix[1:]
+	}
+
+	if suffix == "" {
+		return false
+	}
+	for _, r := range suffix {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkPartitionNotInUse(t *testing.T) {
+	assert.NoError(t, os.MkdirAll("sys-tmp/mmc3/holders", 0755))
+	defer os.RemoveAll("sys-tmp")
+
+	holder, err := os.Create("sys-tmp/mmc3/holders/dm-0")
+	assert.NoError(t, err)
+	holder.Close()
+
+	assert.NoError(t, ioutil.WriteFile("mountinfo-tmp-clean",
+		[]byte("16 15 0:17 / / rw - ext4 /dev/mmc1 rw\n"), 0644))
+	defer os.Remove("mountinfo-tmp-clean")
+
+	assert.NoError(t, ioutil.WriteFile("mountinfo-tmp-mounted",
+		[]byte("16 15 0:17 / /data rw - ext4 /dev/mmc3 rw\n"), 0644))
+	defer os.Remove("mountinfo-tmp-mounted")
+
+	assert.NoError(t, ioutil.WriteFile("mountinfo-tmp-similar-device",
+		[]byte("16 15 0:17 / /data rw - ext4 /dev/mmc22 rw\n"), 0644))
+	defer os.Remove("mountinfo-tmp-similar-device")
+
+	// neither a holder, nor mounted: free to use
+	assert.NoError(t, checkPartitionNotInUse("/dev/mmc2", "sys-tmp", "mountinfo-tmp-clean"))
+
+	// claimed by a device-mapper/LVM/md holder
+	assert.Equal(t, ErrInactivePartitionBusy, checkPartitionNotInUse("/dev/mmc3", "sys-tmp", "mountinfo-tmp-clean"))
+
+	// mounted somewhere in the namespace
+	assert.Equal(t, ErrInactivePartitionBusy, checkPartitionNotInUse("/dev/mmc3", "sys-tmp", "mountinfo-tmp-mounted"))
+
+	// /dev/mmc22 merely has /dev/mmc2 as a string prefix; it must not be
+	// mistaken for a mounted child partition of /dev/mmc2
+	assert.NoError(t, checkPartitionNotInUse("/dev/mmc2", "sys-tmp", "mountinfo-tmp-similar-device"))
+
+	// /dev/mmcblk0p1 genuinely is a child partition of /dev/mmcblk0
+	assert.NoError(t, ioutil.WriteFile("mountinfo-tmp-child-partition",
+		[]byte("16 15 0:17 / /data rw - ext4 /dev/mmcblk0p1 rw\n"), 0644))
+	defer os.Remove("mountinfo-tmp-child-partition")
+	assert.Equal(t, ErrInactivePartitionBusy, checkPartitionNotInUse("/dev/mmcblk0", "sys-tmp", "mountinfo-tmp-child-partition"))
+
+	// an empty device is a string prefix of every mount source; it must
+	// not be mistaken for a match and must not panic.
+	assert.NoError(t, checkPartitionNotInUse("", "sys-tmp", "mountinfo-tmp-clean"))
+}
+
+func Test_isChildPartitionSuffix_EmptyDevice(t *testing.T) {
+	assert.False(t, isChildPartitionSuffix("", "1"))
+	assert.False(t, isChildPartitionSuffix("", ""))
+}
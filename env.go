@@ -0,0 +1,77 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// BootEnvReadWriter abstracts reading and writing bootloader environment
+// variables, so the update logic does not need to know which bootloader is
+// in use.
+type BootEnvReadWriter interface {
+	ReadEnv(names ...string) (map[string]string, error)
+	WriteEnv(map[string]string) error
+}
+
+// BootEnvRunner runs the external tools used to read and write the
+// bootloader environment.
+type BootEnvRunner interface {
+	Command(name string, args ...string) *exec.Cmd
+}
+
+// uBootEnv implements BootEnvReadWriter on top of U-Boot's fw_printenv and
+// fw_setenv tools.
+type uBootEnv struct {
+	BootEnvRunner
+}
+
+// ReadEnv reads the given U-Boot environment variables via fw_printenv.
+func (u uBootEnv) ReadEnv(names ...string) (map[string]string, error) {
+	output, err := u.Command("fw_printenv", names...).CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+	return parseBootEnvOutput(output), nil
+}
+
+// WriteEnv writes the given U-Boot environment variables via fw_setenv.
+// fw_setenv takes one variable per invocation (NAME VALUE); it has no
+// "name=value" argv syntax, so each variable is written with its own call.
+func (u uBootEnv) WriteEnv(vars map[string]string) error {
+	for name, value := range vars {
+		if err := u.Command("fw_setenv", name, value).Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBootEnvOutput turns fw_printenv's "name=value" lines into a map.
+func parseBootEnvOutput(output []byte) map[string]string {
+	vars := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingRunner is a BootEnvRunner that records every invocation's
+// argv instead of running a real command, so tests can assert on the exact
+// command line passed to fw_setenv/fw_printenv.
+type recordingRunner struct {
+	calls *[][]string
+}
+
+func newRecordingRunner() recordingRunner {
+	return recordingRunner{calls: &[][]string{}}
+}
+
+func (r recordingRunner) Command(name string, args ...string) *exec.Cmd {
+	*r.calls = append(*r.calls, append([]string{name}, args...))
+	return exec.Command("true")
+}
+
+func Test_uBootEnv_WriteEnv_OneCallPerVariable(t *testing.T) {
+	runner := newRecordingRunner()
+	u := uBootEnv{BootEnvRunner: runner}
+
+	assert.NoError(t, u.WriteEnv(map[string]string{"boot_part": "3"}))
+
+	assert.Equal(t, [][]string{{"fw_setenv", "boot_part", "3"}}, *runner.calls)
+}
+
+func Test_uBootEnv_WriteEnv_MultipleVariables(t *testing.T) {
+	runner := newRecordingRunner()
+	u := uBootEnv{BootEnvRunner: runner}
+
+	assert.NoError(t, u.WriteEnv(map[string]string{"boot_part": "3", "upgrade_available": "1"}))
+
+	assert.Len(t, *runner.calls, 2)
+	for _, call := range *runner.calls {
+		assert.Equal(t, "fw_setenv", call[0])
+		assert.Len(t, call, 3)
+		assert.NotContains(t, call[1], "=")
+	}
+}
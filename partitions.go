@@ -0,0 +1,413 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// rootDevicePath is the well known symlink the kernel (or initramfs) leaves
+// pointing at the block device the rootfs was mounted from.
+const rootDevicePath = "/dev/root"
+
+// mountedDevDirectory is scanned as a fallback when the currently mounted
+// root device can not be derived directly from `mount`.
+const mountedDevDirectory = "/dev"
+
+// primaryBootPart is the boot_part value expectedBootPart falls back to when
+// the candidate device doesn't end in either configured partition number
+// (e.g. partitionANumber/partitionBNumber weren't set).
+const primaryBootPart = "1"
+
+var (
+	InvalidActivePartition         = errors.New("invalid active partition")
+	ErrorPartitionNumberSame       = errors.New("partition A and B number are the same")
+	ErrorPartitionNumberNotSet     = errors.New("partition number not set")
+	RootPartitionDoesNotMatchMount = errors.New("active root partition does not match any mounted device")
+	ErrorNoMatchBootPartRootPart   = errors.New("boot_part reported by bootloader does not match detected root partition")
+	NotABlockDevice                = errors.New("given file is not a block device")
+)
+
+// StatCommander ties together the two OS facilities partitions needs: running
+// external commands and stat'ing files. Kept as an interface so tests can
+// substitute fakes for both.
+type StatCommander interface {
+	Command(name string, arg ...string) *exec.Cmd
+	Stat(name string) (os.FileInfo, error)
+}
+
+// osCalls is the StatCommander backed by the real OS.
+type osCalls struct{}
+
+func (osCalls) Command(name string, arg ...string) *exec.Cmd {
+	return exec.Command(name, arg...)
+}
+
+func (osCalls) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// partitions keeps track of the A/B rootfs partitions and which one is
+// currently active, so updates can be written to the inactive one.
+type partitions struct {
+	StatCommander
+	Bootloader
+	PartitionResolver
+	partitionANumber string
+	partitionBNumber string
+
+	// partitionAID and partitionBID, if both set, are symbolic
+	// identifiers such as "PARTLABEL=rootfsa"/"PARTLABEL=rootfsb" or
+	// "PARTUUID=...". When present, GetInactive pairs A and B by
+	// resolving these through PartitionResolver instead of matching
+	// partitionANumber/partitionBNumber as a suffix of the active
+	// device node.
+	partitionAID string
+	partitionBID string
+
+	active   string
+	inactive string
+
+	// stateFilePath and recoveryStateFilePath, if set, are where
+	// SaveState/LoadState persist and look up the cached State. Left
+	// empty, state caching is disabled.
+	stateFilePath         string
+	recoveryStateFilePath string
+
+	// Artifact{Name,Checksum}{A,B} record what is currently deployed on
+	// each slot, for SaveState to include in the persisted State.
+	ArtifactNameA     string
+	ArtifactChecksumA string
+	ArtifactNameB     string
+	ArtifactChecksumB string
+
+	blockDevSizeGetFunc func(*os.File) (uint64, error)
+}
+
+// partitionADevice returns the device node of partition A, preferring
+// partitionAID when configured, and otherwise falling back to whichever of
+// active/inactive ends in partitionANumber.
+func (p *partitions) partitionADevice() string {
+	if p.partitionAID != "" && p.PartitionResolver != nil {
+		if device, err := p.Resolve(p.partitionAID); err == nil {
+			return device
+		}
+	}
+	if strings.HasSuffix(p.active, p.partitionANumber) {
+		return p.active
+	}
+	if strings.HasSuffix(p.inactive, p.partitionANumber) {
+		return p.inactive
+	}
+	return ""
+}
+
+// partitionBDevice returns the device node of partition B, preferring
+// partitionBID when configured, and otherwise falling back to whichever of
+// active/inactive ends in partitionBNumber.
+func (p *partitions) partitionBDevice() string {
+	if p.partitionBID != "" && p.PartitionResolver != nil {
+		if device, err := p.Resolve(p.partitionBID); err == nil {
+			return device
+		}
+	}
+	if strings.HasSuffix(p.active, p.partitionBNumber) {
+		return p.active
+	}
+	if strings.HasSuffix(p.inactive, p.partitionBNumber) {
+		return p.inactive
+	}
+	return ""
+}
+
+// expectedBootPart returns the boot_part value the bootloader should report
+// for candidate to be trusted as active: partitionANumber or
+// partitionBNumber, whichever candidate ends in, or primaryBootPart if
+// candidate matches neither.
+func (p *partitions) expectedBootPart(candidate string) string {
+	if p.partitionANumber != "" && strings.HasSuffix(candidate, p.partitionANumber) {
+		return p.partitionANumber
+	}
+	if p.partitionBNumber != "" && strings.HasSuffix(candidate, p.partitionBNumber) {
+		return p.partitionBNumber
+	}
+	return primaryBootPart
+}
+
+// persistState writes the current A/B layout to the configured state file,
+// and its recovery-partition copy if one is configured. Both are
+// best-effort: a write failure here must not fail partition resolution.
+func (p *partitions) persistState() {
+	if p.stateFilePath == "" {
+		return
+	}
+	_ = p.SaveState(p.stateFilePath)
+	if p.recoveryStateFilePath != "" {
+		_ = p.SaveState(p.recoveryStateFilePath)
+	}
+}
+
+// activeFromCachedState tries to resolve the active partition from a
+// previously saved State instead of re-probing mounts, trusting it only if
+// the bootloader's live boot_part still matches what was cached.
+func (p *partitions) activeFromCachedState() (string, bool) {
+	if p.stateFilePath == "" {
+		return "", false
+	}
+
+	state, err := p.LoadState(p.stateFilePath)
+	if err != nil {
+		return "", false
+	}
+
+	bootPart, err := p.Bootloader.GetBootPartition()
+	if err != nil || bootPart != state.BootPart {
+		return "", false
+	}
+
+	switch state.ActiveSlot {
+	case "a":
+		p.active = state.PartitionA.Device
+		p.inactive = state.PartitionB.Device
+	case "b":
+		p.active = state.PartitionB.Device
+		p.inactive = state.PartitionA.Device
+	default:
+		return "", false
+	}
+	return p.active, true
+}
+
+// GetInactive returns the partition that is not currently active. A and B
+// are paired by symbolic identifier when partitionAID/partitionBID are
+// configured, and otherwise by swapping the active partition's trailing
+// partition number.
+func (p *partitions) GetInactive() (string, error) {
+	var inactive string
+	var err error
+
+	if p.partitionAID != "" && p.partitionBID != "" {
+		inactive, err = p.resolveInactiveByIdentifier()
+	} else {
+		inactive, err = p.resolveInactiveByNumber()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.checkInactiveNotInUse(inactive); err != nil {
+		return "", err
+	}
+
+	p.inactive = inactive
+	p.persistState()
+	return inactive, nil
+}
+
+// resolveInactiveByNumber derives the inactive partition from the active
+// one by swapping its trailing partition number.
+func (p *partitions) resolveInactiveByNumber() (string, error) {
+	if p.partitionANumber == "" || p.partitionBNumber == "" {
+		return "", ErrorPartitionNumberNotSet
+	}
+	if p.partitionANumber == p.partitionBNumber {
+		return "", ErrorPartitionNumberSame
+	}
+
+	matchesA := strings.HasSuffix(p.active, p.partitionANumber)
+	matchesB := strings.HasSuffix(p.active, p.partitionBNumber)
+
+	switch {
+	case matchesA && !matchesB:
+		return strings.TrimSuffix(p.active, p.partitionANumber) + p.partitionBNumber, nil
+	case matchesB && !matchesA:
+		return strings.TrimSuffix(p.active, p.partitionBNumber) + p.partitionANumber, nil
+	default:
+		// Either neither partition number suffix matches the active
+		// partition, or (e.g. "2" and "22") both do and the match is
+		// ambiguous. Both cases are configuration errors.
+		return "", InvalidActivePartition
+	}
+}
+
+// resolveInactiveByIdentifier pairs A and B by resolving their symbolic
+// identifiers (PARTLABEL/PARTUUID) to device nodes, sidestepping the whole
+// class of suffix-parsing ambiguities resolveInactiveByNumber has to guard
+// against.
+func (p *partitions) resolveInactiveByIdentifier() (string, error) {
+	deviceA, err := p.Resolve(p.partitionAID)
+	if err != nil {
+		return "", err
+	}
+	deviceB, err := p.Resolve(p.partitionBID)
+	if err != nil {
+		return "", err
+	}
+
+	switch p.active {
+	case deviceA:
+		return deviceB, nil
+	case deviceB:
+		return deviceA, nil
+	default:
+		return "", InvalidActivePartition
+	}
+}
+
+// getRootCandidateFromMount scans the output of `mount` for the entry
+// describing the current root filesystem and returns its device node.
+func getRootCandidateFromMount(output []byte) string {
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == "on" && fields[2] == "/" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// getRootDevice opens the device node the kernel points rootDevicePath at.
+func getRootDevice(sc StatCommander) *os.File {
+	info, err := sc.Stat(rootDevicePath)
+	if err != nil {
+		return nil
+	}
+
+	file, err := os.Open(info.Name())
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+// rootDeviceChecker decides whether the device at path is the one currently
+// mounted as root, given the previously stat'ed root device.
+type rootDeviceChecker func(sc StatCommander, path string, rootStat *syscall.Stat_t) bool
+
+// isSameDevice compares the rdev of path against the root device's rdev.
+func isSameDevice(sc StatCommander, path string, rootStat *syscall.Stat_t) bool {
+	if rootStat == nil {
+		return false
+	}
+	info, err := sc.Stat(path)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return stat.Rdev == rootStat.Rdev
+}
+
+// getRootFromMountedDevices walks mounted, returning the first entry that
+// rootChecker identifies as the currently mounted root device.
+func getRootFromMountedDevices(sc StatCommander, rootChecker rootDeviceChecker,
+	mounted []string, rootStat *syscall.Stat_t) (string, error) {
+
+	for _, candidate := range mounted {
+		if rootChecker(sc, candidate, rootStat) {
+			return candidate, nil
+		}
+	}
+	return "", RootPartitionDoesNotMatchMount
+}
+
+// getAllMountedDevices lists the device nodes found directly under dir.
+func getAllMountedDevices(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		devices = append(devices, filepath.Join(dir, entry.Name()))
+	}
+	return devices, nil
+}
+
+// getAndCacheActivePartition figures out which partition is currently
+// active and caches the result in p.active. A valid cached State takes
+// priority over re-probing; failing that, it trusts the device `mount`
+// reports as root, falling back to scanning mounted devices and
+// cross-checking the result against the bootloader's boot_part variable
+// before trusting it.
+func (p *partitions) getAndCacheActivePartition(rootChecker rootDeviceChecker,
+	mountedDevicesGetter func(string) ([]string, error)) (string, error) {
+
+	if active, ok := p.activeFromCachedState(); ok {
+		return active, nil
+	}
+
+	mountOutput, _ := p.StatCommander.Command("mount").CombinedOutput()
+
+	if candidate := getRootCandidateFromMount(mountOutput); candidate != "" {
+		if !rootChecker(p.StatCommander, candidate, nil) {
+			return "", RootPartitionDoesNotMatchMount
+		}
+		p.active = candidate
+		p.persistState()
+		return p.active, nil
+	}
+
+	mounted, err := mountedDevicesGetter(mountedDevDirectory)
+	if err != nil {
+		return "", RootPartitionDoesNotMatchMount
+	}
+
+	candidate, err := getRootFromMountedDevices(p.StatCommander, rootChecker, mounted, nil)
+	if err != nil {
+		return "", err
+	}
+
+	bootPart, err := p.Bootloader.GetBootPartition()
+	if err != nil || bootPart != p.expectedBootPart(candidate) {
+		return "", ErrorNoMatchBootPartRootPart
+	}
+
+	p.active = candidate
+	p.persistState()
+	return p.active, nil
+}
+
+// getPartitionSize returns the size, in bytes, of partitionFile. Regular
+// files (used in tests, or loop-mounted images) are sized via stat instead
+// of the block device ioctl.
+func (p *partitions) getPartitionSize(partitionFile string) (uint64, error) {
+	file, err := os.Open(partitionFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	size, err := p.blockDevSizeGetFunc(file)
+	if err == NotABlockDevice {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(info.Size()), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
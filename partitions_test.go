@@ -16,6 +16,7 @@ package main
 import (
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"sort"
@@ -49,7 +50,7 @@ func Test_GetInactive_HaveActivePartitionSet_ReturnsInactive(t *testing.T) {
 	for _, testData := range partitionsSetup {
 		fakePartitions := partitions{
 			StatCommander:       new(osCalls),
-			BootEnvReadWriter:   new(uBootEnv),
+			Bootloader:          &uBootBootloader{env: new(uBootEnv)},
 			partitionANumber:    testData.partitionANumber,
 			partitionBNumber:    testData.partitionBNumber,
 			active:              testData.active,
@@ -64,6 +65,64 @@ func Test_GetInactive_HaveActivePartitionSet_ReturnsInactive(t *testing.T) {
 
 }
 
+// fakeResolver is a PartitionResolver backed by a plain lookup table, for
+// tests that pair A/B by identifier without touching a real /dev/disk tree.
+type fakeResolver map[string]string
+
+func (f fakeResolver) Resolve(identifier string) (string, error) {
+	device, ok := f[identifier]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return device, nil
+}
+
+func Test_GetInactive_HaveIdentifiersSet_ReturnsInactive(t *testing.T) {
+	resolver := fakeResolver{
+		"PARTLABEL=rootfsa": "/dev/mmcblk0p2",
+		"PARTLABEL=rootfsb": "/dev/mmcblk0p3",
+	}
+
+	partitionsSetup := []struct {
+		active        string
+		expected      string
+		expectedError error
+	}{
+		{"/dev/mmcblk0p2", "/dev/mmcblk0p3", nil},
+		{"/dev/mmcblk0p3", "/dev/mmcblk0p2", nil},
+		{"/dev/mmcblk0p9", "", InvalidActivePartition},
+	}
+
+	for _, testData := range partitionsSetup {
+		fakePartitions := partitions{
+			StatCommander:     new(osCalls),
+			Bootloader:        &uBootBootloader{env: new(uBootEnv)},
+			PartitionResolver: resolver,
+			partitionAID:      "PARTLABEL=rootfsa",
+			partitionBID:      "PARTLABEL=rootfsb",
+			active:            testData.active,
+		}
+		inactive, err := fakePartitions.GetInactive()
+		if err != testData.expectedError || strings.Compare(testData.expected, inactive) != 0 {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_GetInactive_IdentifiersSet_ResolveError(t *testing.T) {
+	fakePartitions := partitions{
+		StatCommander:     new(osCalls),
+		Bootloader:        &uBootBootloader{env: new(uBootEnv)},
+		PartitionResolver: fakeResolver{},
+		partitionAID:      "PARTLABEL=rootfsa",
+		partitionBID:      "PARTLABEL=rootfsb",
+		active:            "/dev/mmcblk0p2",
+	}
+
+	_, err := fakePartitions.GetInactive()
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
 type fakeStatCommander struct {
 	file     os.FileInfo
 	cmd      *exec.Cmd
@@ -141,6 +200,57 @@ func Test_matchRootWithMout_HaveValidMount(t *testing.T) {
 	}
 }
 
+// fakeBootEnv is an in-memory BootEnvReadWriter used to drive the
+// uBootBootloader side of Test_getActivePartition_noActiveInactiveSet and
+// the bootcount/rollback tests in bootloader_test.go.
+type fakeBootEnv struct {
+	vars map[string]string
+	err  error
+}
+
+func (f fakeBootEnv) ReadEnv(names ...string) (map[string]string, error) {
+	return f.vars, f.err
+}
+
+func (f fakeBootEnv) WriteEnv(vars map[string]string) error {
+	for name, value := range vars {
+		f.vars[name] = value
+	}
+	return nil
+}
+
+// newFakeBootloader builds the Bootloader under test for one of the two
+// supported implementations, with GetBootPartition reporting bootPart, or
+// failing outright if bootPartErr is set.
+func newFakeBootloader(t *testing.T, kind, bootPart string, bootPartErr bool) Bootloader {
+	switch kind {
+	case "uboot":
+		env := fakeBootEnv{vars: map[string]string{"boot_part": bootPart}}
+		if bootPartErr {
+			env.err = errors.New("fw_printenv failed")
+		}
+		return &uBootBootloader{env: env}
+	case "grub":
+		dir, err := ioutil.TempDir("", "mender-grubenv-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		envFile := dir + "/mender_grubenv"
+		if !bootPartErr {
+			content := []byte("mender_boot_part=" + bootPart + "\n")
+			if err := ioutil.WriteFile(envFile, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &grubBootloader{envFile: envFile}
+	default:
+		t.Fatalf("unknown bootloader kind %q", kind)
+		return nil
+	}
+}
+
 // Be ready for the hard stuff...
 // Hope this can be simplified somehow
 func Test_getActivePartition_noActiveInactiveSet(t *testing.T) {
@@ -153,27 +263,13 @@ func Test_getActivePartition_noActiveInactiveSet(t *testing.T) {
 
 	defer os.Remove("tempFile")
 
-	//this will fake all calls to get or set environment variables
-	envCaller := newTestOSCalls("", 0)
-	fakeEnv := uBootEnv{&envCaller}
-
-	fakePartitions := partitions{
-		StatCommander:       &testOS,
-		BootEnvReadWriter:   &fakeEnv,
-		partitionANumber:    "2",
-		partitionBNumber:    "3",
-		active:              "",
-		inactive:            "",
-		blockDevSizeGetFunc: nil,
-	}
-
 	trueChecker := func(StatCommander, string, *syscall.Stat_t) bool { return true }
 	falseChecker := func(StatCommander, string, *syscall.Stat_t) bool { return false }
 
 	testData := []struct {
 		fakeExec       string
-		fakeEnv        string
-		fakeEnvRet     int
+		bootPart       string
+		bootPartErr    bool
 		rootChecker    func(StatCommander, string, *syscall.Stat_t) bool
 		mountOutput    []string
 		mountCallError error
@@ -181,25 +277,41 @@ func Test_getActivePartition_noActiveInactiveSet(t *testing.T) {
 		expectedActive string
 	}{
 		// have mount candidate to return
-		{"/dev/mmcblk0p2 on / type ext4 (rw,errors=remount-ro)", "boot_part=1", 0, trueChecker, nil, nil, nil, "/dev/mmcblk0p2"},
-		{"/dev/mmcblk0p2 on / type ext4 (rw,errors=remount-ro)", "boot_part=1", 0, falseChecker, nil, nil, RootPartitionDoesNotMatchMount, ""},
+		{"/dev/mmcblk0p2 on / type ext4 (rw,errors=remount-ro)", "1", false, trueChecker, nil, nil, nil, "/dev/mmcblk0p2"},
+		{"/dev/mmcblk0p2 on / type ext4 (rw,errors=remount-ro)", "1", false, falseChecker, nil, nil, RootPartitionDoesNotMatchMount, ""},
 		// no mount candidate
-		{"", "boot_part=1", 0, falseChecker, nil, nil, RootPartitionDoesNotMatchMount, ""},
-		{"", "boot_part=1", 0, trueChecker, nil, nil, RootPartitionDoesNotMatchMount, ""},
-		{"", "boot_part=1", 0, trueChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, nil, "/dev/mmc1"},
-		{"", "boot_part=1", 0, falseChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, RootPartitionDoesNotMatchMount, ""},
-		{"", "boot_part=2", 0, trueChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, ErrorNoMatchBootPartRootPart, ""},
-		{"", "boot_part=2", 1, trueChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, ErrorNoMatchBootPartRootPart, ""},
+		{"", "1", false, falseChecker, nil, nil, RootPartitionDoesNotMatchMount, ""},
+		{"", "1", false, trueChecker, nil, nil, RootPartitionDoesNotMatchMount, ""},
+		{"", "1", false, trueChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, nil, "/dev/mmc1"},
+		{"", "1", false, falseChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, RootPartitionDoesNotMatchMount, ""},
+		{"", "2", false, trueChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, ErrorNoMatchBootPartRootPart, ""},
+		{"", "2", true, trueChecker, []string{"/dev/mmc1", "/dev/mmc2"}, nil, ErrorNoMatchBootPartRootPart, ""},
+		// candidate ends in partitionANumber ("2"): boot_part reporting
+		// that same number is a legitimate match, not a mismatch.
+		{"", "2", false, trueChecker, []string{"/dev/mmc2", "/dev/mmc3"}, nil, nil, "/dev/mmc2"},
+		{"", "1", false, trueChecker, []string{"/dev/mmc2", "/dev/mmc3"}, nil, ErrorNoMatchBootPartRootPart, ""},
 	}
 
-	for _, test := range testData {
-		mountedDevicesGetter := func(string) ([]string, error) { return test.mountOutput, test.mountCallError }
-		testOS.output = test.fakeExec
-		envCaller.output = test.fakeEnv
-		envCaller.retCode = test.fakeEnvRet
-		active, err := fakePartitions.getAndCacheActivePartition(test.rootChecker, mountedDevicesGetter)
-		if err != test.expectedError || active != test.expectedActive {
-			t.Fatal(err, active)
+	for _, bootloaderKind := range []string{"uboot", "grub"} {
+		for _, test := range testData {
+			testOS.output = test.fakeExec
+
+			fakePartitions := partitions{
+				StatCommander:       &testOS,
+				Bootloader:          newFakeBootloader(t, bootloaderKind, test.bootPart, test.bootPartErr),
+				partitionANumber:    "2",
+				partitionBNumber:    "3",
+				active:              "",
+				inactive:            "",
+				blockDevSizeGetFunc: nil,
+			}
+
+			mountedDevicesGetter := func(string) ([]string, error) { return test.mountOutput, test.mountCallError }
+			active, err := fakePartitions.getAndCacheActivePartition(test.rootChecker, mountedDevicesGetter)
+			if err != test.expectedError || active != test.expectedActive {
+				t.Fatalf("[%s] getAndCacheActivePartition() = (%v, %q), want (%v, %q)",
+					bootloaderKind, err, active, test.expectedError, test.expectedActive)
+			}
 		}
 	}
 }
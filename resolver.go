@@ -0,0 +1,107 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnknownPartitionIdentifier is returned for an identifier that is
+// neither "PARTLABEL=..." nor "PARTUUID=...".
+var ErrUnknownPartitionIdentifier = errors.New("unrecognised partition identifier")
+
+// byPartlabelDir and byPartuuidDir are where the kernel maintains the GPT
+// PARTLABEL/PARTUUID symlinks. newSymlinkResolver copies them into the
+// symlinkResolver's fields, which tests set to a fake tree instead.
+const (
+	byPartlabelDir = "/dev/disk/by-partlabel"
+	byPartuuidDir  = "/dev/disk/by-partuuid"
+)
+
+// PartitionResolver turns a symbolic partition identifier, such as
+// "PARTLABEL=rootfsa" or "PARTUUID=1111-2222-...", into the device node it
+// currently refers to. This lets A and B be paired by label instead of by
+// numeric suffix arithmetic, which breaks down on eMMC, NVMe, loop devices
+// and LVM.
+type PartitionResolver interface {
+	Resolve(identifier string) (string, error)
+}
+
+// symlinkResolver resolves identifiers by walking the /dev/disk/by-* trees
+// the kernel maintains, falling back to blkid when no matching symlink is
+// found yet (e.g. very early in an initramfs).
+type symlinkResolver struct {
+	byPartlabelDir string
+	byPartuuidDir  string
+	command        func(name string, arg ...string) *exec.Cmd
+}
+
+// newSymlinkResolver builds the production PartitionResolver.
+func newSymlinkResolver() *symlinkResolver {
+	return &symlinkResolver{
+		byPartlabelDir: byPartlabelDir,
+		byPartuuidDir:  byPartuuidDir,
+		command:        exec.Command,
+	}
+}
+
+func (r *symlinkResolver) Resolve(identifier string) (string, error) {
+	key, value, err := splitPartitionIdentifier(identifier)
+	if err != nil {
+		return "", err
+	}
+
+	dir, ok := map[string]string{
+		"PARTLABEL": r.byPartlabelDir,
+		"PARTUUID":  r.byPartuuidDir,
+	}[key]
+	if !ok {
+		return "", ErrUnknownPartitionIdentifier
+	}
+
+	if target, err := filepath.EvalSymlinks(filepath.Join(dir, value)); err == nil {
+		return target, nil
+	}
+
+	return r.resolveWithBlkid(key, value)
+}
+
+// splitPartitionIdentifier splits "PARTLABEL=rootfsa" into ("PARTLABEL",
+// "rootfsa").
+func splitPartitionIdentifier(identifier string) (key, value string, err error) {
+	parts := strings.SplitN(identifier, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrUnknownPartitionIdentifier
+	}
+	return parts[0], parts[1], nil
+}
+
+// resolveWithBlkid falls back to `blkid` when the /dev/disk/by-* symlink
+// tree hasn't been populated yet.
+func (r *symlinkResolver) resolveWithBlkid(key, value string) (string, error) {
+	output, err := r.command("blkid", "-t", key+"="+value, "-o", "device").CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+
+	device := strings.TrimSpace(string(output))
+	if device == "" {
+		return "", os.ErrNotExist
+	}
+	return device, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_symlinkResolver_Resolve_FromSymlinkTree(t *testing.T) {
+	dir := t.TempDir()
+	byPartlabel := filepath.Join(dir, "by-partlabel")
+	byPartuuid := filepath.Join(dir, "by-partuuid")
+	assert.NoError(t, os.MkdirAll(byPartlabel, 0755))
+	assert.NoError(t, os.MkdirAll(byPartuuid, 0755))
+
+	target, err := os.Create(filepath.Join(dir, "mmcblk0p2"))
+	assert.NoError(t, err)
+	target.Close()
+
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "mmcblk0p2"), filepath.Join(byPartlabel, "rootfsa")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "mmcblk0p2"), filepath.Join(byPartuuid, "1111-2222")))
+
+	r := &symlinkResolver{byPartlabelDir: byPartlabel, byPartuuidDir: byPartuuid}
+
+	device, err := r.Resolve("PARTLABEL=rootfsa")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "mmcblk0p2"), device)
+
+	device, err = r.Resolve("PARTUUID=1111-2222")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "mmcblk0p2"), device)
+}
+
+func Test_symlinkResolver_Resolve_FallsBackToBlkid(t *testing.T) {
+	dir := t.TempDir()
+	testOS := newTestOSCalls("/dev/nvme0n1p2\n", 0)
+
+	r := &symlinkResolver{
+		byPartlabelDir: filepath.Join(dir, "by-partlabel"),
+		byPartuuidDir:  filepath.Join(dir, "by-partuuid"),
+		command:        testOS.Command,
+	}
+
+	device, err := r.Resolve("PARTLABEL=rootfsa")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/nvme0n1p2", device)
+}
+
+func Test_symlinkResolver_Resolve_UnknownIdentifier(t *testing.T) {
+	r := newSymlinkResolver()
+
+	_, err := r.Resolve("rootfsa")
+	assert.Equal(t, ErrUnknownPartitionIdentifier, err)
+
+	_, err = r.Resolve("LABEL=rootfsa")
+	assert.Equal(t, ErrUnknownPartitionIdentifier, err)
+}
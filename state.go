@@ -0,0 +1,95 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// SlotState is what is known about one of the two A/B rootfs slots.
+type SlotState struct {
+	Device           string `json:"device"`
+	Number           string `json:"number"`
+	ArtifactName     string `json:"artifact_name,omitempty"`
+	ArtifactChecksum string `json:"artifact_checksum,omitempty"`
+}
+
+// State is the machine-readable snapshot of the A/B layout written to disk
+// by partitions.SaveState, so that an operator or recovery script has an
+// inspectable source of truth after a failed boot, without having to
+// re-probe mounts and bootenv.
+type State struct {
+	PartitionA     SlotState `json:"partition_a"`
+	PartitionB     SlotState `json:"partition_b"`
+	ActiveSlot     string    `json:"active_slot"` // "a" or "b"
+	BootloaderType string    `json:"bootloader_type"`
+	BootPart       string    `json:"boot_part"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// SaveState writes the partitions' current understanding of the A/B layout
+// to path, as JSON.
+func (p *partitions) SaveState(path string) error {
+	state := State{
+		PartitionA: SlotState{
+			Device:           p.partitionADevice(),
+			Number:           p.partitionANumber,
+			ArtifactName:     p.ArtifactNameA,
+			ArtifactChecksum: p.ArtifactChecksumA,
+		},
+		PartitionB: SlotState{
+			Device:           p.partitionBDevice(),
+			Number:           p.partitionBNumber,
+			ArtifactName:     p.ArtifactNameB,
+			ArtifactChecksum: p.ArtifactChecksumB,
+		},
+		Timestamp: time.Now(),
+	}
+
+	switch p.active {
+	case state.PartitionA.Device:
+		state.ActiveSlot = "a"
+	case state.PartitionB.Device:
+		state.ActiveSlot = "b"
+	}
+
+	if p.Bootloader != nil {
+		state.BootloaderType = p.Bootloader.Name()
+		if bootPart, err := p.Bootloader.GetBootPartition(); err == nil {
+			state.BootPart = bootPart
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// LoadState reads back a State previously written by SaveState.
+func (p *partitions) LoadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SaveState_LoadState_RoundTrip(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	p := partitions{
+		partitionANumber: "2",
+		partitionBNumber: "3",
+		active:           "/dev/mmc2",
+		inactive:         "/dev/mmc3",
+		Bootloader:       &uBootBootloader{env: fakeBootEnv{vars: map[string]string{"boot_part": "1"}}},
+	}
+	p.ArtifactNameA = "release-v1"
+	p.ArtifactChecksumA = "abc123"
+
+	assert.NoError(t, p.SaveState(statePath))
+
+	loaded, err := p.LoadState(statePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", loaded.ActiveSlot)
+	assert.Equal(t, "uboot", loaded.BootloaderType)
+	assert.Equal(t, "1", loaded.BootPart)
+	assert.Equal(t, "/dev/mmc2", loaded.PartitionA.Device)
+	assert.Equal(t, "/dev/mmc3", loaded.PartitionB.Device)
+	assert.Equal(t, "release-v1", loaded.PartitionA.ArtifactName)
+	assert.Equal(t, "abc123", loaded.PartitionA.ArtifactChecksum)
+	assert.False(t, loaded.Timestamp.IsZero())
+}
+
+func Test_getAndCacheActivePartition_PrefersValidCachedState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	cached := partitions{
+		partitionANumber: "2",
+		partitionBNumber: "3",
+		active:           "/dev/mmc2",
+		inactive:         "/dev/mmc3",
+		Bootloader:       &uBootBootloader{env: fakeBootEnv{vars: map[string]string{"boot_part": "1"}}},
+	}
+	assert.NoError(t, cached.SaveState(statePath))
+
+	testOS := newTestOSCalls("garbage, no root line here", 0)
+	p := partitions{
+		StatCommander:    &testOS,
+		Bootloader:       &uBootBootloader{env: fakeBootEnv{vars: map[string]string{"boot_part": "1"}}},
+		partitionANumber: "2",
+		partitionBNumber: "3",
+		stateFilePath:    statePath,
+	}
+
+	// rootChecker and mountedDevicesGetter would both fail the request if
+	// consulted, proving the cached state short-circuits them.
+	failChecker := func(StatCommander, string, *syscall.Stat_t) bool { return false }
+	failMountedDevicesGetter := func(string) ([]string, error) { return nil, errors.New("should not be called") }
+
+	active, err := p.getAndCacheActivePartition(failChecker, failMountedDevicesGetter)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mmc2", active)
+	assert.Equal(t, "/dev/mmc3", p.inactive)
+}
+
+func Test_getAndCacheActivePartition_IgnoresStaleCachedState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	cached := partitions{
+		partitionANumber: "2",
+		partitionBNumber: "3",
+		active:           "/dev/mmc2",
+		inactive:         "/dev/mmc3",
+		Bootloader:       &uBootBootloader{env: fakeBootEnv{vars: map[string]string{"boot_part": "1"}}},
+	}
+	assert.NoError(t, cached.SaveState(statePath))
+
+	testOS := newTestOSCalls("/dev/mmc3 on / type ext4 (rw)", 0)
+	// boot_part has since moved on: the bootloader now reports "2",
+	// which no longer matches the cached state's "1".
+	p := partitions{
+		StatCommander:    &testOS,
+		Bootloader:       &uBootBootloader{env: fakeBootEnv{vars: map[string]string{"boot_part": "2"}}},
+		partitionANumber: "2",
+		partitionBNumber: "3",
+		stateFilePath:    statePath,
+	}
+
+	trueChecker := func(StatCommander, string, *syscall.Stat_t) bool { return true }
+	active, err := p.getAndCacheActivePartition(trueChecker, getAllMountedDevices)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mmc3", active)
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+// testOSCalls fakes StatCommander (and BootEnvRunner) for tests that need a
+// real *exec.Cmd whose output and exit code are under the test's control.
+// Command re-execs the test binary itself in TestHelperProcess mode.
+type testOSCalls struct {
+	output  string
+	retCode int
+	err     error
+	file    os.FileInfo
+}
+
+func newTestOSCalls(output string, retCode int) testOSCalls {
+	return testOSCalls{output: output, retCode: retCode}
+}
+
+func (s testOSCalls) Command(name string, arg ...string) *exec.Cmd {
+	args := append([]string{"-test.run=TestHelperProcess", "--", name}, arg...)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = []string{
+		"GO_WANT_HELPER_PROCESS=1",
+		"HELPER_PROCESS_OUTPUT=" + s.output,
+		"HELPER_PROCESS_RETCODE=" + strconv.Itoa(s.retCode),
+	}
+	return cmd
+}
+
+func (s testOSCalls) Stat(name string) (os.FileInfo, error) {
+	return s.file, s.err
+}
+
+// TestHelperProcess isn't a real test. It's a stand-in process exec'ed by
+// testOSCalls.Command to emulate running an external command.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprint(os.Stdout, os.Getenv("HELPER_PROCESS_OUTPUT"))
+	code, _ := strconv.Atoi(os.Getenv("HELPER_PROCESS_RETCODE"))
+	os.Exit(code)
+}